@@ -0,0 +1,183 @@
+package serve
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ErrReadClosed is returned from Write when the read side of a
+// BufferedPipedBody has already been closed, so nothing will ever drain
+// the buffer again.
+var ErrReadClosed = errors.New("serve: read side of piped body closed")
+
+// ErrWriteClosed is returned from Write when the write side of a
+// BufferedPipedBody has already been closed through CloseWithError.
+var ErrWriteClosed = errors.New("serve: write side of piped body closed")
+
+// BufferedPipedBody is a sibling of PipedBody that interposes a bounded
+// ring buffer of up to maxBuf bytes between the writer and the reader.
+// Unlike PipedBody, which is based on an unbuffered io.Pipe and forces
+// the producer and the consumer to rendezvous on every Read/Write,
+// BufferedPipedBody lets the producer run ahead of the consumer up to
+// maxBuf bytes: Write only blocks once the buffer is full, and Read
+// only blocks once it is empty.
+//
+// To get an initialized instance, use NewBufferedPipedBody().
+type BufferedPipedBody struct {
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	buf        []byte
+	start, n   int
+	readClosed bool
+
+	writeClosed bool
+	closeErr    error
+}
+
+// NewBufferedPipedBody creates a buffered body object that can be used
+// to stream content from filters, the same way as NewPipedBody, but
+// with an internal ring buffer of up to maxBuf bytes absorbing the
+// difference in speed between the producer and the consumer.
+func NewBufferedPipedBody(maxBuf int) *BufferedPipedBody {
+	if maxBuf <= 0 {
+		maxBuf = 1
+	}
+
+	b := &BufferedPipedBody{buf: make([]byte, maxBuf)}
+	b.notEmpty = sync.NewCond(&b.mu)
+	b.notFull = sync.NewCond(&b.mu)
+	return b
+}
+
+// Read implements io.Reader. It blocks only while the buffer is empty
+// and the write side is still open. Once the write side was closed with
+// CloseWithError, Read first drains the remaining buffered bytes, and
+// only then starts returning the close error.
+func (b *BufferedPipedBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.n == 0 && !b.writeClosed {
+		b.notEmpty.Wait()
+	}
+
+	if b.n == 0 {
+		return 0, b.closeErr
+	}
+
+	rn := copy(p, b.readView(b.start, min(len(p), b.n)))
+	b.start = (b.start + rn) % len(b.buf)
+	b.n -= rn
+	b.notFull.Signal()
+	return rn, nil
+}
+
+// Write implements io.Writer. It blocks only while the buffer is full
+// and the read side is still open. If the read side was already closed,
+// Write fails with ErrReadClosed. If the write side was already closed
+// with CloseWithError, Write fails with ErrWriteClosed.
+func (b *BufferedPipedBody) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writeClosed {
+		return 0, ErrWriteClosed
+	}
+
+	written := 0
+	for written < len(p) {
+		for b.n == len(b.buf) && !b.readClosed && !b.writeClosed {
+			b.notFull.Wait()
+		}
+
+		if b.writeClosed {
+			return written, ErrWriteClosed
+		}
+
+		if b.readClosed {
+			return written, ErrReadClosed
+		}
+
+		free := len(b.buf) - b.n
+		wn := min(len(p)-written, free)
+		pos := (b.start + b.n) % len(b.buf)
+		b.writeInto(pos, p[written:written+wn])
+		b.n += wn
+		written += wn
+		b.notEmpty.Signal()
+	}
+
+	return written, nil
+}
+
+// readView returns a slice view of length n starting at pos in the ring
+// buffer, for reading. When the span wraps around the end, the two
+// parts cannot be expressed as a single slice, so they are copied into
+// a freshly allocated one; this is safe for reads, which only need the
+// bytes, not the aliasing.
+func (b *BufferedPipedBody) readView(pos, n int) []byte {
+	end := pos + n
+	if end <= len(b.buf) {
+		return b.buf[pos:end]
+	}
+
+	out := make([]byte, n)
+	first := copy(out, b.buf[pos:])
+	copy(out[first:], b.buf[:n-first])
+	return out
+}
+
+// writeInto copies p into the ring buffer starting at pos, wrapping
+// around the end if needed. Unlike readView, it must write through to
+// the real backing array, so it copies piecewise into b.buf directly
+// instead of going through an intermediate slice.
+func (b *BufferedPipedBody) writeInto(pos int, p []byte) {
+	first := copy(b.buf[pos:], p)
+	if first < len(p) {
+		copy(b.buf[:len(p)-first], p[first:])
+	}
+}
+
+// CloseWithError closes the write side of the body. Bytes already
+// queued in the buffer are still delivered to the reader; once they are
+// drained, Read returns err, or io.EOF when err is nil.
+func (b *BufferedPipedBody) CloseWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writeClosed {
+		return
+	}
+
+	if err == nil {
+		err = io.EOF
+	}
+
+	b.closeErr = err
+	b.writeClosed = true
+	b.notEmpty.Broadcast()
+	b.notFull.Broadcast()
+}
+
+// Close closes the read side of the body, signaling ErrReadClosed to a
+// blocked or future Write call. It is used by the consumer to give up
+// reading before the producer is done writing.
+func (b *BufferedPipedBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.readClosed = true
+	b.notFull.Broadcast()
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,145 @@
+package serve
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBufferedPipedBodyWrapAroundRoundTrip(t *testing.T) {
+	b := NewBufferedPipedBody(8)
+
+	if _, err := b.Write([]byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got := make([]byte, 4)
+	if n, err := b.Read(got); err != nil || n != 4 {
+		t.Fatalf("Read: n=%d err=%v", n, err)
+	}
+
+	// start is now at index 4; writing 6 more bytes wraps past the end
+	// of the 8 byte ring buffer.
+	want := []byte{5, 6, 7, 8, 9, 10}
+	if _, err := b.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got = make([]byte, len(want))
+	if n, err := b.Read(got); err != nil || n != len(want) {
+		t.Fatalf("Read: n=%d err=%v", n, err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestBufferedPipedBodyCloseWithErrorDrains(t *testing.T) {
+	b := NewBufferedPipedBody(4)
+
+	if _, err := b.Write([]byte{1, 2}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	b.CloseWithError(nil)
+
+	got := make([]byte, 2)
+	if n, err := b.Read(got); err != nil || n != 2 {
+		t.Fatalf("Read: n=%d err=%v", n, err)
+	}
+
+	if !bytes.Equal(got, []byte{1, 2}) {
+		t.Fatalf("got %v, want [1 2]", got)
+	}
+
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF after drain, got %v", err)
+	}
+}
+
+func TestBufferedPipedBodyWriteAfterClose(t *testing.T) {
+	b := NewBufferedPipedBody(4)
+	b.CloseWithError(nil)
+
+	if _, err := b.Write([]byte{1}); err != ErrWriteClosed {
+		t.Fatalf("expected ErrWriteClosed, got %v", err)
+	}
+}
+
+// TestBufferedPipedBodyWriteBlocksWhenFull exercises the backpressure
+// that is the whole point of BufferedPipedBody: a Write that would
+// overflow the buffer blocks until a Read makes room, rather than
+// either dropping data or deadlocking forever.
+func TestBufferedPipedBodyWriteBlocksWhenFull(t *testing.T) {
+	b := NewBufferedPipedBody(2)
+
+	if _, err := b.Write([]byte{1, 2}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	writeReturned := make(chan struct{})
+	go func() {
+		if _, err := b.Write([]byte{3, 4}); err != nil {
+			t.Errorf("Write: %v", err)
+		}
+
+		close(writeReturned)
+	}()
+
+	select {
+	case <-writeReturned:
+		t.Fatal("Write returned before Read made room in the full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := b.Read(make([]byte, 2)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	select {
+	case <-writeReturned:
+	case <-time.After(time.Second):
+		t.Fatal("Write did not unblock after Read drained the buffer")
+	}
+}
+
+// TestBufferedPipedBodyWriteAfterReadClosed covers the consumer-gone
+// path: once the reader calls Close, a blocked or future Write must
+// fail with ErrReadClosed instead of hanging forever.
+func TestBufferedPipedBodyWriteAfterReadClosed(t *testing.T) {
+	b := NewBufferedPipedBody(2)
+	b.Close()
+
+	if _, err := b.Write([]byte{1}); err != ErrReadClosed {
+		t.Fatalf("expected ErrReadClosed, got %v", err)
+	}
+}
+
+// TestBufferedPipedBodyWriteUnblocksOnReadClose covers the same path
+// while a Write is already blocked on a full buffer.
+func TestBufferedPipedBodyWriteUnblocksOnReadClose(t *testing.T) {
+	b := NewBufferedPipedBody(2)
+
+	if _, err := b.Write([]byte{1, 2}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := b.Write([]byte{3, 4})
+		writeErr <- err
+	}()
+
+	b.Close()
+
+	select {
+	case err := <-writeErr:
+		if err != ErrReadClosed {
+			t.Fatalf("expected ErrReadClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Write did not unblock after Close")
+	}
+}
@@ -4,12 +4,24 @@ Package serve provides utilities for filters that need to modify the response bo
 package serve
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/zalando/skipper/filters"
 )
 
+// statusClientClosedRequest is the nginx-originated, non-standard
+// status code used to report that the client canceled the request
+// before the handler could produce a response.
+const statusClientClosedRequest = 499
+
 // A PipeBody can be used to stream data from filters. To get
 // an initialized instance, use NewPipedBody().
 type PipedBody struct {
@@ -17,12 +29,69 @@ type PipedBody struct {
 	writer       *io.PipeWriter
 	closed       chan struct{}
 	writerClosed chan struct{}
+	closeWriter  sync.Once
+	closeAll     sync.Once
 }
 
 type pipedResponse struct {
-	response   *http.Response
-	body       *PipedBody
-	headerDone chan struct{}
+	ctx              filters.FilterContext
+	response         *http.Response
+	body             *PipedBody
+	headerDone       chan struct{}
+	headerOnce       sync.Once
+	closeNotify      chan bool
+	maxBodyBytes     int64
+	bodyBytesWritten int64
+}
+
+// ContextLogger is an optional interface that a filters.FilterContext
+// implementation can support to expose a logger, so that
+// ServeHTTPWithOptions can report recovered handler panics through it
+// when Options.OnPanic is nil.
+type ContextLogger interface {
+	Logger() interface {
+		Errorf(format string, args ...interface{})
+	}
+}
+
+// Options controls the finer details of ServeHTTPWithOptions.
+type Options struct {
+	// Timeout bounds how long the handler is allowed to run. When it
+	// elapses before the handler returns, the request's context is
+	// canceled and the piped body is closed with
+	// context.DeadlineExceeded. Zero means no timeout.
+	Timeout time.Duration
+
+	// OnPanic, when set, is called with the recovered value whenever
+	// the handler panics, instead of logging it through the
+	// FilterContext's ContextLogger hook.
+	OnPanic func(interface{})
+
+	// MaxBodyBytes, when positive, caps the number of bytes the
+	// handler may write to the response body. The write that would
+	// cross the limit is truncated to it, fails with an error, and
+	// closes the body; this applies within that single Write call, not
+	// just to the ones after it.
+	MaxBodyBytes int64
+}
+
+// ContextHijacker is an optional interface that a filters.FilterContext
+// implementation can support to expose the underlying network
+// connection of the proxy request. When the context passed to
+// ServeHTTP implements it, the handler's ResponseWriter also
+// implements http.Hijacker, e.g. to upgrade the connection to
+// WebSocket.
+type ContextHijacker interface {
+	Hijack() (net.Conn, *bufio.ReadWriter, error)
+}
+
+// ContextPusher is an optional interface that a filters.FilterContext
+// implementation can support to expose HTTP/2 server push on the
+// underlying proxy connection. When the context passed to ServeHTTP
+// implements it, the handler's ResponseWriter also implements
+// http.Pusher.
+type ContextPusher interface {
+	Push(target string, opts *http.PushOptions) error
 }
 
 // NewPipedBody creates a body object, that can be
@@ -86,30 +155,26 @@ func (b *PipedBody) Write(p []byte) (int, error) {
 
 // CloseWithError closes the writer side of the pipe.
 // It can be used to signal an io.EOF on the reader
-// side.
+// side. It is safe to call concurrently, e.g. from both
+// the goroutine running the handler and a goroutine
+// watching for request cancellation; only the first call
+// takes effect.
 func (b *PipedBody) CloseWithError(err error) {
-	select {
-	case <-b.writerClosed:
-		return
-	default:
-	}
-
-	b.writer.CloseWithError(err)
-	close(b.writerClosed)
+	b.closeWriter.Do(func() {
+		b.writer.CloseWithError(err)
+		close(b.writerClosed)
+	})
 }
 
 // Close closes the pipe. If the writer was not closed
 // before, it signals an io.EOF.
 func (b *PipedBody) Close() error {
-	select {
-	case <-b.closed:
-		return nil
-	default:
-	}
+	b.closeAll.Do(func() {
+		b.CloseWithError(io.EOF)
+		b.reader.Close()
+		close(b.closed)
+	})
 
-	b.CloseWithError(io.EOF)
-	b.reader.Close()
-	close(b.closed)
 	return nil
 }
 
@@ -131,15 +196,60 @@ func (b *PipedBody) Close() error {
 // 	}
 //
 func ServeHTTP(ctx filters.FilterContext, h http.Handler) {
+	ServeHTTPWithOptions(ctx, h, Options{})
+}
+
+// ServeHTTPWithOptions is like ServeHTTP, but additionally:
+//
+//   - it derives the request passed to h from ctx.Request().Context(),
+//     optionally bounded by Options.Timeout, and propagates its
+//     cancellation (client disconnect, FilterContext timeout) to the
+//     piped body's reader side via PipedBody.CloseWithError, so the
+//     outer proxy loop does not keep blocking on a pipe that nobody
+//     will ever finish writing to;
+//   - it recovers panics raised by h, reporting them through
+//     Options.OnPanic, or through the FilterContext's ContextLogger
+//     hook when OnPanic is nil, and translates them into a 500 status
+//     when WriteHeader was not called yet, or into a CloseWithError
+//     otherwise;
+//   - if reqCtx is done before h calls WriteHeader, e.g. because h
+//     ignores cancellation and keeps blocking on something of its own,
+//     it stops waiting and synthesizes a 504 or 499 response itself, so
+//     this call, and the calling proxy path, are not left hanging for
+//     the full handler duration;
+//   - it caps the response body at Options.MaxBodyBytes, when positive,
+//     truncating the write that would cross the limit.
+func ServeHTTPWithOptions(ctx filters.FilterContext, h http.Handler, o Options) {
 	rsp := &http.Response{Header: make(http.Header)}
 	body := NewPipedBody()
 	d := &pipedResponse{
-		response:   rsp,
-		body:       body,
-		headerDone: make(chan struct{})}
+		ctx:          ctx,
+		response:     rsp,
+		body:         body,
+		headerDone:   make(chan struct{}),
+		closeNotify:  make(chan bool, 1),
+		maxBodyBytes: o.MaxBodyBytes}
+
+	var reqCtx context.Context
+	var cancel context.CancelFunc
+	if o.Timeout > 0 {
+		reqCtx, cancel = context.WithTimeout(ctx.Request().Context(), o.Timeout)
+	} else {
+		reqCtx, cancel = context.WithCancel(ctx.Request().Context())
+	}
+
+	req := ctx.Request().WithContext(reqCtx)
+	done := make(chan struct{})
 
-	req := ctx.Request()
 	go func() {
+		defer cancel()
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				recoverHandlerPanic(d, body, o, r)
+			}
+		}()
+
 		h.ServeHTTP(d, req)
 		select {
 		case <-d.headerDone:
@@ -147,20 +257,90 @@ func ServeHTTP(ctx filters.FilterContext, h http.Handler) {
 			d.WriteHeader(http.StatusOK)
 		}
 
-		body.CloseWithError(io.EOF)
+		// If the request was canceled, prefer that error over io.EOF,
+		// regardless of whether this goroutine or the one watching
+		// reqCtx.Done() below wins the race to close the body first;
+		// CloseWithError only takes the first call into account.
+		if err := reqCtx.Err(); err != nil {
+			body.CloseWithError(err)
+		} else {
+			body.CloseWithError(io.EOF)
+		}
 	}()
 
-	<-d.headerDone
+	go func() {
+		select {
+		case <-done:
+		case <-reqCtx.Done():
+			body.CloseWithError(reqCtx.Err())
+			select {
+			case d.closeNotify <- true:
+			default:
+			}
+		}
+	}()
+
+	// A handler that ignores req's context and blocks on something of
+	// its own (a slow upstream call, a stray time.Sleep) would
+	// otherwise keep this call, and the calling proxy path, hung until
+	// the handler eventually returns. Once reqCtx is done, give up on
+	// waiting for the handler and synthesize a response instead.
+	select {
+	case <-d.headerDone:
+	case <-reqCtx.Done():
+		d.WriteHeader(statusForContextError(reqCtx.Err()))
+	}
+
 	rsp.Body = d
 	ctx.Serve(rsp)
 }
 
+// statusForContextError maps a context error to the status code of the
+// response synthesized when a handler is still running after its
+// context is done. context.DeadlineExceeded means Options.Timeout
+// elapsed; anything else means the client went away.
+func statusForContextError(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	return statusClientClosedRequest
+}
+
+// recoverHandlerPanic turns a recovered handler panic into a response:
+// a 500 status, if the header was not written yet, or a CloseWithError
+// on the body otherwise. It then reports the panic through
+// Options.OnPanic, or through the FilterContext's ContextLogger hook
+// when OnPanic is nil.
+func recoverHandlerPanic(d *pipedResponse, body *PipedBody, o Options, r interface{}) {
+	select {
+	case <-d.headerDone:
+		body.CloseWithError(fmt.Errorf("serve: handler panic: %v", r))
+	default:
+		d.WriteHeader(http.StatusInternalServerError)
+		body.CloseWithError(io.EOF)
+	}
+
+	if o.OnPanic != nil {
+		o.OnPanic(r)
+		return
+	}
+
+	if l, ok := d.ctx.(ContextLogger); ok {
+		l.Logger().Errorf("serve: recovered handler panic: %v", r)
+	}
+}
+
 func (d *pipedResponse) Read(data []byte) (int, error) { return d.body.Read(data) }
 func (d *pipedResponse) Header() http.Header           { return d.response.Header }
 
 // Implements http.ResponseWriter.Write. When WriteHeader was
 // not called before Write, it calls it with the default 200
-// status code.
+// status code. When the pipedResponse was created through
+// ServeHTTPWithOptions with a positive Options.MaxBodyBytes, the part
+// of data that would cross that limit, if any, is dropped before being
+// forwarded to the body, and Write closes the body and returns an
+// error for this call already, rather than only failing the next one.
 func (d *pipedResponse) Write(data []byte) (int, error) {
 	select {
 	case <-d.headerDone:
@@ -168,17 +348,79 @@ func (d *pipedResponse) Write(data []byte) (int, error) {
 		d.WriteHeader(http.StatusOK)
 	}
 
-	return d.body.Write(data)
+	if d.maxBodyBytes > 0 && int64(len(data)) > d.maxBodyBytes-d.bodyBytesWritten {
+		remaining := d.maxBodyBytes - d.bodyBytesWritten
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		n, err := d.body.Write(data[:remaining])
+		d.bodyBytesWritten += int64(n)
+		if err == nil {
+			err = fmt.Errorf("serve: response body exceeds the %d byte limit", d.maxBodyBytes)
+		}
+
+		d.body.CloseWithError(err)
+		return n, err
+	}
+
+	n, err := d.body.Write(data)
+	d.bodyBytesWritten += int64(n)
+	return n, err
 }
 
 // It sets the status code for the outgoing response, and
-// signals that the header is done.
+// signals that the header is done. Only the first call has
+// an effect, so a handler that calls WriteHeader after
+// ServeHTTPWithOptions already synthesized a response for it
+// does not panic on a second close of headerDone.
 func (d *pipedResponse) WriteHeader(status int) {
-	d.response.StatusCode = status
-	close(d.headerDone)
+	d.headerOnce.Do(func() {
+		d.response.StatusCode = status
+		close(d.headerDone)
+	})
 }
 
 func (d *pipedResponse) Close() error {
 	d.body.Close()
 	return nil
 }
+
+// Flush implements http.Flusher. Since the underlying body is an
+// unbuffered pipe, every Write is already visible to the reader as
+// soon as it returns, so Flush is a NOOP kept only to satisfy the
+// interface for handlers that rely on it, e.g. to stream SSE.
+func (d *pipedResponse) Flush() {}
+
+// CloseNotify implements the deprecated http.CloseNotifier. The
+// returned channel receives a value once the original proxy request
+// was canceled or the client connection was closed.
+func (d *pipedResponse) CloseNotify() <-chan bool {
+	return d.closeNotify
+}
+
+// Hijack implements http.Hijacker by tunneling to the underlying proxy
+// connection through the ContextHijacker hook, when the FilterContext
+// passed to ServeHTTP supports it. This unblocks handlers that need to
+// take over the raw connection, e.g. gorilla websocket.
+func (d *pipedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := d.ctx.(ContextHijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return h.Hijack()
+}
+
+// Push implements http.Pusher by forwarding to the ContextPusher hook,
+// when the FilterContext passed to ServeHTTP supports it and the
+// downstream client speaks HTTP/2. Otherwise it returns
+// http.ErrNotSupported, as required by the http.Pusher contract.
+func (d *pipedResponse) Push(target string, opts *http.PushOptions) error {
+	p, ok := d.ctx.(ContextPusher)
+	if !ok || d.ctx.Request().ProtoMajor < 2 {
+		return http.ErrNotSupported
+	}
+
+	return p.Push(target, opts)
+}
@@ -0,0 +1,88 @@
+package serve
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+func TestServeHTTPWithOptionsPanicRecovery(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := &filtertest.Context{FRequest: req}
+
+	ServeHTTPWithOptions(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), Options{})
+
+	if ctx.FResponse.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want %d", ctx.FResponse.StatusCode, http.StatusInternalServerError)
+	}
+}
+
+func TestServeHTTPWithOptionsContextCancellation(t *testing.T) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(reqCtx)
+	ctx := &filtertest.Context{FRequest: req}
+
+	ServeHTTPWithOptions(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		<-r.Context().Done()
+	}), Options{})
+
+	cancel()
+
+	_, err := ctx.FResponse.Body.Read(make([]byte, 1))
+	if err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestServeHTTPWithOptionsTimeoutBeforeHeader(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := &filtertest.Context{FRequest: req}
+
+	done := make(chan struct{})
+	start := time.Now()
+	ServeHTTPWithOptions(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		time.Sleep(500 * time.Millisecond) // ignores r.Context() on purpose
+	}), Options{Timeout: 50 * time.Millisecond})
+
+	if elapsed := time.Since(start); elapsed >= 500*time.Millisecond {
+		t.Fatalf("ServeHTTPWithOptions waited for the handler, took %s", elapsed)
+	}
+
+	if ctx.FResponse.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("got status %d, want %d", ctx.FResponse.StatusCode, http.StatusGatewayTimeout)
+	}
+
+	<-done
+}
+
+func TestServeHTTPWithOptionsMaxBodyBytesTruncatesSingleWrite(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := &filtertest.Context{FRequest: req}
+
+	writeErr := make(chan error, 1)
+	ServeHTTPWithOptions(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := w.Write(make([]byte, 1000))
+		writeErr <- err
+		if n != 10 {
+			t.Errorf("got n=%d, want 10", n)
+		}
+	}), Options{MaxBodyBytes: 10})
+
+	got := make([]byte, 1000)
+	n, _ := ctx.FResponse.Body.Read(got)
+	if n != 10 {
+		t.Fatalf("reader got %d bytes, want 10", n)
+	}
+
+	if err := <-writeErr; err == nil {
+		t.Fatal("expected Write to fail once the limit is reached within the same call")
+	}
+}
@@ -0,0 +1,119 @@
+package serve
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zalando/skipper/filters/filtertest"
+)
+
+// hijackableContext adds a ContextHijacker implementation on top of a
+// plain filtertest.Context, so the tests can exercise pipedResponse's
+// Hijack method without depending on a real proxy connection.
+type hijackableContext struct {
+	*filtertest.Context
+	conn net.Conn
+}
+
+func (c *hijackableContext) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw := bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
+	return c.conn, rw, nil
+}
+
+func TestServeHTTPFlush(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := &filtertest.Context{FRequest: req}
+
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		ServeHTTP(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+		}))
+	}()
+
+	<-handlerDone
+
+	body := make([]byte, 5)
+	if _, err := ctx.FResponse.Body.Read(body); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if string(body) != "chunk" {
+		t.Fatalf("got %q, want %q", body, "chunk")
+	}
+}
+
+func TestServeHTTPCloseNotify(t *testing.T) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(reqCtx)
+	ctx := &filtertest.Context{FRequest: req}
+
+	notified := make(chan struct{})
+	go ServeHTTP(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-w.(http.CloseNotifier).CloseNotify()
+		close(notified)
+	}))
+
+	cancel()
+
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Fatal("CloseNotify did not fire after request cancellation")
+	}
+}
+
+func TestServeHTTPHijack(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := &hijackableContext{Context: &filtertest.Context{FRequest: req}, conn: server}
+
+	hijacked := make(chan net.Conn, 1)
+	go ServeHTTP(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+
+		hijacked <- conn
+	}))
+
+	select {
+	case conn := <-hijacked:
+		if conn != server {
+			t.Fatal("Hijack did not return the underlying connection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not hijack the connection")
+	}
+}
+
+func TestServeHTTPPushNotSupported(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	ctx := &filtertest.Context{FRequest: req}
+
+	pushErr := make(chan error, 1)
+	go ServeHTTP(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushErr <- w.(http.Pusher).Push("/style.css", nil)
+	}))
+
+	select {
+	case err := <-pushErr:
+		if err != http.ErrNotSupported {
+			t.Fatalf("got %v, want http.ErrNotSupported", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handler did not call Push")
+	}
+}
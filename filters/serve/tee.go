@@ -0,0 +1,89 @@
+package serve
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TeePipedBody is a PipedBody that, besides streaming writes through to
+// the reader untouched, mirrors them into a bounded internal buffer so
+// that filters can inspect a copy of the response body once it was
+// captured. Use NewTeePipedBody to get an initialized instance, and
+// Snapshot to read back the captured bytes.
+type TeePipedBody struct {
+	*PipedBody
+
+	mu       sync.Mutex
+	snapshot []byte
+	limit    int64
+
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// NewTeePipedBody creates a PipedBody that mirrors every write into an
+// internal buffer capped at limit bytes, silently dropping bytes past
+// the limit, and that closes itself with context.DeadlineExceeded if no
+// write arrives for longer than timeout. A non-positive timeout
+// disables the stall detection. The tee side never blocks the primary
+// pipeline: capturing the snapshot is pure in-memory bookkeeping done
+// on the writer's goroutine before the write is forwarded.
+func NewTeePipedBody(limit int64, timeout time.Duration) *TeePipedBody {
+	t := &TeePipedBody{PipedBody: NewPipedBody(), limit: limit, timeout: timeout}
+
+	if timeout > 0 {
+		t.mu.Lock()
+		t.timer = time.AfterFunc(timeout, func() {
+			t.CloseWithError(context.DeadlineExceeded)
+		})
+		t.mu.Unlock()
+	}
+
+	return t
+}
+
+// Write captures up to limit bytes of p into the snapshot buffer, then
+// delegates to the embedded PipedBody's Write.
+func (t *TeePipedBody) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+
+	if room := t.limit - int64(len(t.snapshot)); room > 0 {
+		n := int64(len(p))
+		if n > room {
+			n = room
+		}
+
+		t.snapshot = append(t.snapshot, p[:n]...)
+	}
+	t.mu.Unlock()
+
+	return t.PipedBody.Write(p)
+}
+
+// Snapshot returns a copy of the bytes captured so far, up to the
+// configured limit. It is safe to call while writes are still in
+// progress, but it is meant to be read once the body was closed.
+func (t *TeePipedBody) Snapshot() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make([]byte, len(t.snapshot))
+	copy(out, t.snapshot)
+	return out
+}
+
+// CloseWithError stops the stall timeout, if any, and closes the
+// embedded PipedBody, as documented in PipedBody.CloseWithError.
+func (t *TeePipedBody) CloseWithError(err error) {
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.mu.Unlock()
+
+	t.PipedBody.CloseWithError(err)
+}
@@ -0,0 +1,41 @@
+package serve
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTeePipedBodySnapshotTruncation(t *testing.T) {
+	tee := NewTeePipedBody(4, 0)
+	defer tee.CloseWithError(nil)
+
+	go func() {
+		tee.Write([]byte("hello world"))
+	}()
+
+	read := make([]byte, 11)
+	if _, err := tee.Read(read); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if !bytes.Equal(read, []byte("hello world")) {
+		t.Fatalf("stream got %q, want %q", read, "hello world")
+	}
+
+	if got := tee.Snapshot(); !bytes.Equal(got, []byte("hell")) {
+		t.Fatalf("snapshot got %q, want %q", got, "hell")
+	}
+}
+
+func TestTeePipedBodyTimeout(t *testing.T) {
+	tee := NewTeePipedBody(16, 20*time.Millisecond)
+
+	// no Write ever happens, so the stall timer should fire and close
+	// the body with context.DeadlineExceeded.
+	_, err := tee.Read(make([]byte, 2))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+}